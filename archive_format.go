@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// archiveFormat describes how to produce and serve one of the archive
+// methods accepted by the archiveMethod URL part.
+type archiveFormat struct {
+	// contentType is sent back as the Content-Type header when serving the
+	// archive.
+	contentType string
+	// tar, if non-empty, is handed to GNU tar's -a/--auto-compress flag as
+	// the output file extension so tar picks the matching compressor
+	// itself. Adding a new tar-based format is then just one more table
+	// entry, no extra branch.
+	tar bool
+}
+
+// archiveFormats maps an archiveMethod to how it is packed and served. The
+// zero value for archiveMethods not found here means "unsupported".
+var archiveFormats = map[string]archiveFormat{
+	"tar.xz":  {contentType: "application/x-tar", tar: true},
+	"tar.gz":  {contentType: "application/gzip", tar: true},
+	"tar.zst": {contentType: "application/zstd", tar: true},
+	"zip":     {contentType: "application/zip"},
+}
+
+// sortedArchiveMethods returns the supported archiveMethod keys, used only
+// for building a helpful error message.
+func sortedArchiveMethods() []string {
+	methods := make([]string, 0, len(archiveFormats))
+	for m := range archiveFormats {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// createZipArchive zips the given dirs (paths relative to root, as found in
+// the ?s= sparse-checkout set) into outPath. It is implemented with
+// archive/zip instead of shelling out to a zip binary so the server doesn't
+// need one installed. renames, if non-nil, renames each dir's top-level
+// entry inside the zip (see applyRename); the on-disk clone is untouched.
+func createZipArchive(root string, dirs []string, outPath string, renames map[string]string) error {
+	out, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", outPath, err)
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, dir := range dirs {
+		src := filepath.Join(root, dir)
+		err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := applyRename(filepath.ToSlash(rel), renames)
+			if info.Mode()&os.ModeSymlink != 0 {
+				return addSymlinkToZip(zw, p, name, info)
+			}
+			return addFileToZip(zw, p, name, info)
+		})
+		if err != nil {
+			zw.Close()
+			return fmt.Errorf("failed to add %q to zip: %w", dir, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// applyRename rewrites relPath's top-level path segment to renames[segment]
+// if that segment has an entry, leaving the rest of relPath untouched.
+func applyRename(relPath string, renames map[string]string) string {
+	if len(renames) == 0 {
+		return relPath
+	}
+	top, rest, hasRest := strings.Cut(relPath, "/")
+	newTop, ok := renames[top]
+	if !ok {
+		return relPath
+	}
+	if !hasRest {
+		return newTop
+	}
+	return newTop + "/" + rest
+}
+
+// addFileToZip copies the file at path into zw under the given archive
+// name, preserving the file's mode.
+func addFileToZip(zw *zip.Writer, path, name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// addSymlinkToZip writes the symlink at path into zw under the given
+// archive name as a symlink entry (target string as the body, ModeSymlink
+// set in the header) instead of following it, matching the tar path's
+// behavior of storing the link rather than the contents it points at - a
+// sparse checkout can contain a symlink pointing outside of it, and
+// dereferencing that on the zip path would let a crafted ref read arbitrary
+// files off the server.
+func addSymlinkToZip(zw *zip.Writer, path, name string, info os.FileInfo) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Store
+	header.SetMode(os.ModeSymlink | 0777)
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+// tarAutoCompressCommand builds a `tar -a ...` command that lets tar derive
+// the compressor from cacheFilePath's extension. renames, if non-nil, is
+// turned into one `--transform` per entry so tar rewrites each top-level
+// directory's name as it writes the archive, LLVM-release-tarball style,
+// without touching the clone on disk.
+func tarAutoCompressCommand(clonePath, cacheFilePath, setJoined string, renames map[string]string) string {
+	return fmt.Sprintf(`tar -C %q%s -acf %q %s`, clonePath, tarRenameTransforms(renames), cacheFilePath, setJoined)
+}
+
+// tarRenameTransforms renders renames as a space-separated, sorted (for a
+// stable, reproducible command line) sequence of `--transform=` flags.
+func tarRenameTransforms(renames map[string]string) string {
+	if len(renames) == 0 {
+		return ""
+	}
+	tops := make([]string, 0, len(renames))
+	for top := range renames {
+		tops = append(tops, top)
+	}
+	sort.Strings(tops)
+
+	var b strings.Builder
+	for _, top := range tops {
+		fmt.Fprintf(&b, ` --transform='s,^%s\(/\|$\),%s\1,'`, sedEscapeBRE(top), renames[top])
+	}
+	return b.String()
+}
+
+// sedEscapeBRE escapes "." - the only basic-regex metacharacter
+// validateGitArg still allows through (the rest, e.g. * [ ] ^ $, are
+// already rejected as shell metacharacters) - so a top-level directory name
+// that happens to contain a dot (e.g. "foo.bar") is matched literally by
+// tar's --transform instead of "." acting as a wildcard over sibling
+// directories.
+func sedEscapeBRE(s string) string {
+	return strings.ReplaceAll(s, ".", `\.`)
+}
+
+// parseRenameSpec parses a ?rename=old:new,old2:new2 query value into a map
+// from a top-level directory name (as it appears in ?s=) to the name it
+// should be presented as inside the built archive. Each side is validated
+// with validateGitArg so a crafted old/new can't break out of the zip entry
+// name or the tar --transform sed expression above.
+func parseRenameSpec(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	renames := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		old, new, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("rename %q must be of the form old:new", pair)
+		}
+		if err := validateGitArg("rename old name", old); err != nil {
+			return nil, err
+		}
+		if err := validateGitArg("rename new name", new); err != nil {
+			return nil, err
+		}
+		renames[old] = new
+	}
+	return renames, nil
+}
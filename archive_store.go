@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrArchiveNotFound is returned by Stat, Open and Delete when name doesn't
+// exist in the store.
+var ErrArchiveNotFound = errors.New("archive not found in store")
+
+// ArchiveEntry describes one object held by an ArchiveStore.
+type ArchiveEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ArchiveStore is where built archives are kept. HandleArchive and
+// cleanCache go through it instead of touching localArchiveCacheDir
+// directly, so the backing storage is a deployment choice (-archive-storage)
+// rather than something baked into the handler.
+type ArchiveStore interface {
+	// Stat reports name's size and mod time, or ErrArchiveNotFound if it
+	// doesn't exist.
+	Stat(name string) (ArchiveEntry, error)
+	// Put stores the contents read from r under name, overwriting any
+	// existing object of that name.
+	Put(name string, r io.Reader) error
+	// Open returns a reader for name along with its ArchiveEntry. The
+	// caller must close the reader. Returns ErrArchiveNotFound if name
+	// doesn't exist.
+	Open(name string) (io.ReadCloser, ArchiveEntry, error)
+	// Delete removes name, or returns ErrArchiveNotFound if it doesn't
+	// exist.
+	Delete(name string) error
+	// List returns every entry currently in the store.
+	List() ([]ArchiveEntry, error)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBuildLocked is returned by coalesceBuild to a waiter that gave up on an
+// in-flight build instead of sharing its result. It mirrors Argo CD's
+// revision-cache lock sentinel so HandleArchive can tell "still building,
+// retry me" apart from a real build failure and answer with 409 Retry-After.
+var ErrBuildLocked = errors.New("archive build is locked by another request")
+
+// buildEntry tracks one in-flight build so concurrent requests for the same
+// archiveCacheName share its result instead of each starting their own
+// clone, sparse-checkout and pack.
+type buildEntry struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+var (
+	buildEntriesMu sync.Mutex
+	buildEntries   = map[string]*buildEntry{}
+)
+
+// coalesceBuild ensures only one goroutine runs build for a given key at a
+// time. The first caller for a key runs build and stores its result for
+// everyone else; later callers wait for that result (up to
+// buildWaitTimeout) instead of repeating the work. A waiter that times out
+// gets ErrBuildLocked back.
+func coalesceBuild(key string, build func() error) error {
+	buildEntriesMu.Lock()
+	if entry, ok := buildEntries[key]; ok {
+		buildEntriesMu.Unlock()
+		return waitForBuild(entry)
+	}
+
+	entry := &buildEntry{}
+	entry.wg.Add(1)
+	buildEntries[key] = entry
+	buildEntriesMu.Unlock()
+
+	entry.err = build()
+	entry.wg.Done()
+
+	buildEntriesMu.Lock()
+	delete(buildEntries, key)
+	buildEntriesMu.Unlock()
+
+	return entry.err
+}
+
+// waitForBuild blocks until entry's build finishes or buildWaitTimeout
+// elapses.
+func waitForBuild(entry *buildEntry) error {
+	done := make(chan struct{})
+	go func() {
+		entry.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return entry.err
+	case <-time.After(buildWaitTimeout):
+		return ErrBuildLocked
+	}
+}
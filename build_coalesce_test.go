@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCoalesceBuildSharesOneExecution fires N concurrent callers at the same
+// key and asserts build runs exactly once, with every caller observing its
+// result - the behavior HandleArchive relies on to turn a thundering herd of
+// requests for one ref into a single clone+tar.
+func TestCoalesceBuildSharesOneExecution(t *testing.T) {
+	buildWaitTimeout = time.Second
+	defer func() { buildWaitTimeout = 0 }()
+
+	const callers = 20
+	var runs int32
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make([]error, callers)
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = coalesceBuild("same-key", func() error {
+				atomic.AddInt32(&runs, 1)
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&runs); got != 1 {
+		t.Fatalf("build ran %d times, want 1", got)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: coalesceBuild returned %v, want nil", i, err)
+		}
+	}
+}
+
+// TestCoalesceBuildDifferentKeysRunIndependently guards against a key
+// collision regressing into a global lock: two distinct keys must each get
+// their own execution.
+func TestCoalesceBuildDifferentKeysRunIndependently(t *testing.T) {
+	buildWaitTimeout = time.Second
+	defer func() { buildWaitTimeout = 0 }()
+
+	var runs int32
+	var wg sync.WaitGroup
+	for _, key := range []string{"key-a", "key-b"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			_ = coalesceBuild(key, func() error {
+				atomic.AddInt32(&runs, 1)
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+		}(key)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&runs); got != 2 {
+		t.Fatalf("build ran %d times across 2 distinct keys, want 2", got)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// GitError is returned by GitRunner.Run when the git invocation fails. It
+// keeps the captured stdout/stderr around so callers can report a useful
+// message without re-running the command.
+type GitError struct {
+	Args   []string
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+func (e *GitError) Error() string {
+	return fmt.Sprintf("git %s: %v: %s", strings.Join(e.Args, " "), e.Err, strings.TrimSpace(e.Stderr))
+}
+
+func (e *GitError) Unwrap() error { return e.Err }
+
+// GitRunner runs git as a real subprocess argument vector instead of a
+// shell string, so caller-controlled values (revisionOrTag, ?s= entries)
+// can never be interpreted by a shell. Use gitRunner instead of calling
+// exec.Command("git", ...) directly.
+type GitRunner struct{}
+
+// Run executes `git <args...>` in dir (the repo's root if dir is empty) and
+// returns its combined stdout. ctx is honored via exec.CommandContext, so a
+// caller that threads r.Context() through gets its in-flight clone,
+// checkout or reset killed as soon as the HTTP client disconnects.
+func (g *GitRunner) Run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	debugLog.Printf("git %s", strings.Join(args, " "))
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// Never block on credential prompts and never pick up a system-wide
+	// gitconfig that could redirect what we clone/checkout.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_NOSYSTEM=1")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), &GitError{Args: args, Stdout: stdout.String(), Stderr: stderr.String(), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+// gitRunner is the single GitRunner every git invocation in this package
+// goes through.
+var gitRunner = &GitRunner{}
+
+// shellMetacharacters are rejected outright in revisionOrTag and ?s=
+// entries. They have no legitimate meaning there - refs and paths don't
+// contain them - so any of these strongly suggests an attempt to break out
+// of the argument vector they're placed in. Whitespace is included even
+// though it isn't a shell metacharacter in the traditional sense: ?s=
+// entries are space-joined and handed to tarAutoCompressCommand, which
+// builds an unquoted `sh -c` command line, so an entry containing a space
+// would get word-split into separate (nonexistent) tar paths instead of
+// being rejected up front like every other disallowed character here.
+const shellMetacharacters = "|&;$()`<>\\\"'*?[]{}~!#%^\n \t"
+
+// validateGitArg rejects a revisionOrTag or ?s= entry that contains shell
+// metacharacters (including whitespace - see shellMetacharacters), a ".."
+// path segment, a leading "-" (which git would otherwise parse as an
+// option) or an absolute path. name is used only to make the returned
+// error message identify which value was rejected.
+func validateGitArg(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s must not be empty", name)
+	}
+	if strings.ContainsAny(value, shellMetacharacters) {
+		return fmt.Errorf("%s %q contains a disallowed character", name, value)
+	}
+	if strings.HasPrefix(value, "-") {
+		return fmt.Errorf("%s %q must not start with %q", name, value, "-")
+	}
+	if strings.HasPrefix(value, "/") {
+		return fmt.Errorf("%s %q must not be an absolute path", name, value)
+	}
+	for _, part := range strings.Split(value, "/") {
+		if part == ".." {
+			return fmt.Errorf("%s %q must not contain %q", name, value, "..")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// localArchiveStore keeps archives as plain files in a directory on disk.
+// It's the default ArchiveStore and what the server has always done.
+type localArchiveStore struct {
+	dir string
+}
+
+// newLocalArchiveStore returns a localArchiveStore rooted at dir, creating
+// dir if it doesn't already exist.
+func newLocalArchiveStore(dir string) (*localArchiveStore, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		infoLog.Printf("creating archive cache directory in %q", dir)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	} else {
+		infoLog.Printf("using already existing archive cache directory %q", dir)
+	}
+	return &localArchiveStore{dir: dir}, nil
+}
+
+func (s *localArchiveStore) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *localArchiveStore) Stat(name string) (ArchiveEntry, error) {
+	info, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return ArchiveEntry{}, ErrArchiveNotFound
+	}
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+	return ArchiveEntry{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localArchiveStore) Put(name string, r io.Reader) error {
+	f, err := os.Create(s.path(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (s *localArchiveStore) Open(name string) (io.ReadCloser, ArchiveEntry, error) {
+	entry, err := s.Stat(name)
+	if err != nil {
+		return nil, ArchiveEntry{}, err
+	}
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, ArchiveEntry{}, err
+	}
+	return f, entry, nil
+}
+
+func (s *localArchiveStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+func (s *localArchiveStore) List() ([]ArchiveEntry, error) {
+	fileInfo, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ArchiveEntry, 0, len(fileInfo))
+	for _, info := range fileInfo {
+		entries = append(entries, ArchiveEntry{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return entries, nil
+}
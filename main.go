@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -13,12 +15,11 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -67,10 +68,6 @@ func Chain(f http.HandlerFunc, middlewares ...Middleware) http.HandlerFunc {
 	return f
 }
 
-func HandleStatus(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Healthy\n")
-}
-
 // Checks for a proper request.
 // a) * Sees if the requested archive file is already existing in the cache.
 //    * Immediately return if it exsits
@@ -78,12 +75,25 @@ func HandleStatus(w http.ResponseWriter, r *http.Request) {
 // TODO(kwk): Forward to github when s=/ or s=. ?
 func HandleArchive(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	repoName := vars["repo"]
 	archiveMethod := vars["archiveMethod"]
 	revisionOrTag := vars["revisionOrTag"]
 	archiveName := vars["archiveName"]
 
-	if archiveMethod != "tar.xz" && archiveMethod != "zip" {
-		http.Error(w, fmt.Sprintf("wrong archive type (must be tar.xz or zip): %q", archiveMethod), http.StatusBadRequest)
+	repo, ok := mirror.Get(repoName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown repo %q", repoName), http.StatusNotFound)
+		return
+	}
+
+	format, ok := archiveFormats[archiveMethod]
+	if !ok {
+		http.Error(w, fmt.Sprintf("wrong archive type (must be one of %s): %q", strings.Join(sortedArchiveMethods(), ", "), archiveMethod), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateGitArg("revisionOrTag", revisionOrTag); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -98,41 +108,61 @@ func HandleArchive(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "please provide at least one ?s=path/to/a/dir/to/include/in/archive", http.StatusBadRequest)
 		return
 	}
+	for _, s := range set {
+		if err := validateGitArg("s", s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Whether or not a fresh clone is desired.
 	// Useful when a tag was updated to point at different revision.
 	freshClone, _ := strconv.ParseBool(queryMap.Get("freshClone"))
 
+	// Optional ?rename=old:new,old2:new2 to present top-level directories
+	// under a different name inside the archive, LLVM-release-tarball
+	// style (e.g. clang -> clang-13.0.0-src), without touching the clone.
+	renameSpec := queryMap.Get("rename")
+	renames, err := parseRenameSpec(renameSpec)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	sort.Strings(set)
 	setJoined := strings.Join(set, " ")
 
-	// Calculate sha1 hash name based on revision + sparse checkout set + archive type
+	// Calculate sha1 hash name based on repo + revision + sparse checkout set + archive type
 	// TODO(kwk): What about collisions? Too unlikely?
+	// renameSpec is folded in so a renamed and a non-renamed archive of the
+	// same repo/revision/set coexist in the store under different names.
 	h := sha1.New()
-	h.Write([]byte(revisionOrTag + setJoined))
-	archiveCacheName := revisionOrTag + "-" + hex.EncodeToString(h.Sum(nil)) + "." + archiveMethod
+	h.Write([]byte(repoName + revisionOrTag + setJoined + renameSpec))
+	archiveCacheName := repoName + "-" + revisionOrTag + "-" + hex.EncodeToString(h.Sum(nil)) + "." + archiveMethod
 
-	// Serves a file as a response
-	serveFile := func(filePath string) {
-		w.Header().Set(http.CanonicalHeaderKey("Content-Disposition"), fmt.Sprintf("attachment; filename=%s", archiveName))
-		switch archiveMethod {
-		case "tar.xz":
-			debugLog.Println("setting tar.xz content type")
-			w.Header().Set(http.CanonicalHeaderKey("Content-Type"), "application/x-tar")
-			break
-		case "zip":
-			debugLog.Println("setting zip content type")
-			w.Header().Set(http.CanonicalHeaderKey("Content-Type"), "application/zip")
+	// Serves the named archive store entry as a response
+	serveArchive := func(name string) {
+		rc, entry, err := archiveStore.Open(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to open archive %q: %v", name, err), http.StatusInternalServerError)
+			return
 		}
+		defer rc.Close()
+
+		w.Header().Set(http.CanonicalHeaderKey("Content-Disposition"), fmt.Sprintf("attachment; filename=%s", archiveName))
+		debugLog.Printf("setting %s content type", archiveMethod)
+		w.Header().Set(http.CanonicalHeaderKey("Content-Type"), format.contentType)
+		w.Header().Set(http.CanonicalHeaderKey("Content-Length"), strconv.FormatInt(entry.Size, 10))
 
-		http.ServeFile(w, r, filePath)
+		io.Copy(w, rc)
 	}
 
-	// TODO(kwk): How to prevent another handler from creating this cache file? File-based locking or just a program mutex?
-	cacheFilePath := filepath.Join(localArchiveCacheDir, archiveCacheName)
-	if _, err := os.Stat(cacheFilePath); !os.IsNotExist(err) {
+	if _, err := archiveStore.Stat(archiveCacheName); err == nil {
 		infoLog.Println("found archive in cache and returning it immediately.")
-		serveFile(cacheFilePath)
+		serveArchive(archiveCacheName)
+		return
+	} else if !errors.Is(err, ErrArchiveNotFound) {
+		http.Error(w, fmt.Sprintf("failed to stat archive %q: %v", archiveCacheName, err), http.StatusInternalServerError)
 		return
 	}
 
@@ -140,61 +170,96 @@ func HandleArchive(w http.ResponseWriter, r *http.Request) {
 	h = sha1.New()
 	h.Write([]byte(revisionOrTag + setJoined))
 	cloneDirName := revisionOrTag + "-" + hex.EncodeToString(h.Sum(nil))
-	clonePath := filepath.Join(gitLocalClonesDir, cloneDirName)
+	clonePath := filepath.Join(gitLocalClonesDir, repoName, cloneDirName)
 
 	if freshClone {
 		infoLog.Printf("fresh clone requested, removing any old clone of revision %q in %q", revisionOrTag, clonePath)
 		_ = os.RemoveAll(clonePath)
 	}
 
-	gitMirrorRWMutex.RLock()
-	defer gitMirrorRWMutex.RUnlock()
+	// Only one goroutine clones/checks-out/packs a given archiveCacheName at
+	// a time; everybody else waits for that build to finish (or times out)
+	// instead of racing it. See coalesceBuild.
+	err = coalesceBuild(archiveCacheName, func() error {
+		repo.RLock()
+		defer repo.RUnlock()
+
+		// Follows r.Context() so a disconnecting client aborts the build,
+		// and also forceKillCtx so a build still running once the grace
+		// period in main elapses gets its subprocess killed instead of
+		// left to finish in an exiting process.
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		go func() {
+			select {
+			case <-forceKillCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
 
-	if _, err := os.Stat(clonePath); os.IsNotExist(err) || freshClone {
-		log.Printf("cloning revision %q into %q (freshClone=%t)", revisionOrTag, clonePath, freshClone)
-		command := `git clone --branch=main --depth=1 --filter=blob:none --sparse --reference=%[1]q %[2]s %[3]q`
-		_, err := executeCommand(command, gitLocalMirrorDir, gitRepositoryURL, clonePath)
-		if err != nil {
-			// TODO(kwk): always log error before returning it with http.Error and also add status code to logs
-			http.Error(w, fmt.Sprintf("failed to create partial clone: %v", err), http.StatusInternalServerError)
-			return
+		if _, err := os.Stat(clonePath); os.IsNotExist(err) || freshClone {
+			log.Printf("cloning revision %q of repo %q into %q (freshClone=%t)", revisionOrTag, repoName, clonePath, freshClone)
+			if _, err := gitRunner.Run(ctx, "", "clone", "--branch="+repo.DefaultBranch, "--depth=1", "--filter=blob:none", "--sparse", "--reference="+repo.LocalMirrorDir, repo.URL, clonePath); err != nil {
+				return fmt.Errorf("failed to create partial clone: %w", err)
+			}
+		} else {
+			infoLog.Printf("using already existing clone of revision %q in %q (freshClone=%t)", revisionOrTag, clonePath, freshClone)
 		}
-	} else {
-		infoLog.Printf("using already existing clone of revision %q in %q (freshClone=%t)", revisionOrTag, clonePath, freshClone)
-	}
 
-	infoLog.Printf("sparse checkout of %q at revision %q in %q", setJoined, revisionOrTag, clonePath)
-	command := `git -C %[1]q sparse-checkout init --cone && git -C %[1]q sparse-checkout set %s && git -C %[1]q reset --hard %[3]q`
-	_, err = executeCommand(command, clonePath, setJoined, revisionOrTag)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to sparse checkout %q in %q at revision %q: %v", setJoined, clonePath, revisionOrTag, err), http.StatusInternalServerError)
-		return
-	}
+		infoLog.Printf("sparse checkout of %q at revision %q in %q", setJoined, revisionOrTag, clonePath)
+		if _, err := gitRunner.Run(ctx, clonePath, "sparse-checkout", "init", "--cone"); err != nil {
+			return fmt.Errorf("failed to init sparse checkout in %q: %w", clonePath, err)
+		}
+		if _, err := gitRunner.Run(ctx, clonePath, append([]string{"sparse-checkout", "set"}, set...)...); err != nil {
+			return fmt.Errorf("failed to sparse checkout %q in %q: %w", setJoined, clonePath, err)
+		}
+		if _, err := gitRunner.Run(ctx, clonePath, "reset", "--hard", revisionOrTag); err != nil {
+			return fmt.Errorf("failed to reset %q to revision %q: %w", clonePath, revisionOrTag, err)
+		}
 
-	// TODO(kwk): Include time output for each task?
-	infoLog.Printf("compressing of %q in %q into %q", setJoined, clonePath, cacheFilePath)
+		// TODO(kwk): Include time output for each task?
+		buildPath := filepath.Join(os.TempDir(), archiveCacheName)
+		defer os.Remove(buildPath)
+		infoLog.Printf("compressing of %q in %q into %q", setJoined, clonePath, buildPath)
+
+		if format.tar {
+			if _, err := executeCommandContext(ctx, tarAutoCompressCommand(clonePath, buildPath, setJoined, renames)); err != nil {
+				return err
+			}
+		} else if err := createZipArchive(clonePath, set, buildPath, renames); err != nil {
+			return err
+		}
+
+		built, err := os.Open(buildPath)
+		if err != nil {
+			return fmt.Errorf("failed to open built archive %q: %w", buildPath, err)
+		}
+		defer built.Close()
+
+		return archiveStore.Put(archiveCacheName, built)
+	})
 
-	switch archiveMethod {
-	case "tar.xz":
-		// TODO(kwk): Notice that I'm not renaming the directories like its done for LLVM releases (e.g. clang -> clang-13.0.0-src)
-		command = fmt.Sprintf(`tar -C %q -cJf %q %s`, clonePath, cacheFilePath, setJoined)
-	default:
-		http.Error(w, fmt.Sprintf("archive method not implemented: %q", archiveMethod), http.StatusNotImplemented)
-		return
-	}
-	_, err = executeCommand(command)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to pack %q: %v", setJoined, err), http.StatusInternalServerError)
+		if errors.Is(err, ErrBuildLocked) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(buildWaitTimeout.Seconds())))
+			http.Error(w, fmt.Sprintf("archive %q is already being built by another request, retry shortly", archiveCacheName), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to build archive %q: %v", archiveCacheName, err), http.StatusInternalServerError)
 		return
 	}
 
-	serveFile(cacheFilePath)
+	serveArchive(archiveCacheName)
 }
 
-// Executes the command after formatting it with the given args.
-func executeCommand(command string, args ...interface{}) ([]byte, error) {
+// executeCommandContext runs command under a shell. It's only left for the
+// tar step, which still builds a GNU tar -a invocation from a format
+// string; ctx lets a disconnecting HTTP client kill an in-flight tar the
+// same way it kills gitRunner's clone/checkout/reset.
+func executeCommandContext(ctx context.Context, command string) ([]byte, error) {
 	debugLog.Println(command)
-	cmd := exec.Command("sh", "-c", command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
 	stdoutStderr, err := cmd.CombinedOutput()
 	debugLog.Println(string(stdoutStderr))
 	if err != nil {
@@ -203,33 +268,42 @@ func executeCommand(command string, args ...interface{}) ([]byte, error) {
 	return stdoutStderr, nil
 }
 
-// Prints the command to be executed to the log and executes it.
-// If the execution fails, a fatal log is written.
-func executeCommandOrFatalLog(command string, args ...interface{}) {
-	command = fmt.Sprintf(command, args...)
-	debugLog.Println(command)
-	cmd := exec.Command("sh", "-c", command)
-
-	stdoutStderr, err := cmd.CombinedOutput()
-	debugLog.Println(string(stdoutStderr))
-	if err != nil {
-		errLog.Fatal(err)
-	}
-}
-
 // TODO(kwk): Cleanup: Create a handler and stuff variables in there out of global space
 var (
-	gitMirrorRWMutex               sync.RWMutex
 	gitLocalClonesDir              string
 	localArchiveCacheDir           string
-	gitLocalMirrorDir              string
-	gitRepositoryURL               string
+	configPath                     string
 	gitUpdateMirrorTickerDuration  time.Duration
 	shutDownWaitDuration           time.Duration
 	listenAddress                  string
 	logLevel                       string
 	cleanCacheTickerDuration       time.Duration
 	cleanCacheRemoveFilesOlderThan time.Duration
+	buildWaitTimeout               time.Duration
+	archiveStorageKind             string
+	s3Endpoint                     string
+	s3Bucket                       string
+	s3BasePath                     string
+	s3UseSSL                       bool
+
+	archiveStore ArchiveStore
+	mirror       *Mirror
+
+	// shutdownCtx is cancelled with its reason as soon as a signal is
+	// received. Background tickers (mirror updates, cache cleaning) watch
+	// it so they stop scheduling new work right away instead of racing the
+	// process exit.
+	shutdownCtx    context.Context
+	shutdownCancel context.CancelCauseFunc
+
+	// forceKillCtx is cancelled only if shutDownWaitDuration elapses with
+	// archive builds still in flight. HandleArchive's per-build context
+	// watches it (in addition to its own request's context) so a forced
+	// shutdown kills the build's git/tar subprocess instead of orphaning
+	// it, while a build that finishes within the grace period is left
+	// alone.
+	forceKillCtx    context.Context
+	forceKillCancel context.CancelCauseFunc
 
 	errLog   *log.Logger
 	warnLog  *log.Logger
@@ -238,56 +312,67 @@ var (
 )
 
 func cleanCache() {
-	fileInfo, err := ioutil.ReadDir(localArchiveCacheDir)
+	entries, err := archiveStore.List()
 	if err != nil {
-		errLog.Fatalf("failed to read cache dir %q: %v", localArchiveCacheDir, err)
+		errLog.Fatalf("failed to list archive store: %v", err)
 		return
 	}
 	now := time.Now()
-	for _, info := range fileInfo {
-		if diff := now.Sub(info.ModTime()); diff > cleanCacheRemoveFilesOlderThan {
-			debugLog.Printf("deleting %s which is %s old\n", info.Name(), diff)
-			p := path.Join(localArchiveCacheDir, info.Name())
-			err := os.Remove(p)
-			if err != nil {
-				errLog.Fatalf("failed to delete %q: %v", p, err)
+	for _, entry := range entries {
+		if diff := now.Sub(entry.ModTime); diff > cleanCacheRemoveFilesOlderThan {
+			debugLog.Printf("deleting %s which is %s old\n", entry.Name, diff)
+			if err := archiveStore.Delete(entry.Name); err != nil {
+				errLog.Fatalf("failed to delete %q: %v", entry.Name, err)
 				return
 			}
 		}
 	}
 }
 
-func setupArchivesCache() {
-	if _, err := os.Stat(localArchiveCacheDir); os.IsNotExist(err) {
-		infoLog.Printf("creating archive cache directory in %q", localArchiveCacheDir)
-		err := os.MkdirAll(localArchiveCacheDir, 0777)
+func setupArchiveStore() {
+	switch archiveStorageKind {
+	case "local":
+		store, err := newLocalArchiveStore(localArchiveCacheDir)
 		if err != nil {
-			errLog.Fatalf("failed to create archive dir %q: %v", localArchiveCacheDir, err)
+			errLog.Fatalf("failed to set up local archive store in %q: %v", localArchiveCacheDir, err)
 		}
-	} else {
-		infoLog.Printf("using already existing archive cache directory %q", localArchiveCacheDir)
+		archiveStore = store
+	case "s3":
+		store, err := newS3ArchiveStore(s3Endpoint, s3Bucket, s3BasePath, s3UseSSL)
+		if err != nil {
+			errLog.Fatalf("failed to set up s3 archive store: %v", err)
+		}
+		archiveStore = store
+	default:
+		errLog.Fatalf("unknown -archive-storage %q (must be local or s3)", archiveStorageKind)
 	}
+}
+
+func setupArchivesCache() {
+	setupArchiveStore()
 
 	// Setup ticker for updating the git mirror
 	if cleanCacheTickerDuration != 0 {
 		cleanCacheTicker := time.NewTicker(cleanCacheTickerDuration)
 		go func() {
+			defer cleanCacheTicker.Stop()
 			for {
 				select {
 				case t := <-cleanCacheTicker.C:
 					infoLog.Printf("cleaning cache at %s", t)
 					cleanCache()
+				case <-shutdownCtx.Done():
+					infoLog.Printf("stopping cache cleaning: %v", context.Cause(shutdownCtx))
+					return
 				}
 			}
 		}()
-		defer cleanCacheTicker.Stop()
 	}
 
 }
 
 func setupFlags() {
-	flag.StringVar(&gitRepositoryURL, "git-repository-url ", "git@github.com:llvm/llvm-project.git", "What project to checkout")
-	flag.StringVar(&gitLocalMirrorDir, "git-local-mirror-dir", "llvm-project.git", "Where to store the mirror of the remote repository")
+	flag.StringVar(&configPath, "config", "repos.yaml", "YAML (or JSON) file listing the repositories to mirror and serve archives from")
 	flag.DurationVar(&shutDownWaitDuration, "graceful-timeout", time.Second*15, "The duration for which the server gracefully waits for existing connections to finish - e.g. 15s or 1m")
 	flag.StringVar(&listenAddress, "listen-address", "0.0.0.0:8080", "Address to start HTTP server on")
 	flag.StringVar(&localArchiveCacheDir, "archive-cache-dir", "cache", "Where to store archives for later re-use")
@@ -298,6 +383,12 @@ func setupFlags() {
 	flag.StringVar(&logLevel, "log-level", "info", "Minimum log level (debug < info < warning < error)")
 	flag.DurationVar(&cleanCacheTickerDuration, "clean-cache-ticker-duration", 1*time.Hour, "How often to run cache cleaning, e.g. 15s or 1m or 0 to disable")
 	flag.DurationVar(&cleanCacheRemoveFilesOlderThan, "clean-cache-remove-files-older-than", 24*time.Hour, "Delete cache files older this duration, e.g. 15s or 1m or 0 to disable")
+	flag.DurationVar(&buildWaitTimeout, "build-wait-timeout", time.Minute*2, "How long a request waits for another request's in-flight archive build of the same key before giving up with 409 Retry-After - e.g. 15s or 1m")
+	flag.StringVar(&archiveStorageKind, "archive-storage", "local", "Where to keep built archives: local or s3")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "", "S3-compatible endpoint host:port, required when -archive-storage=s3")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "Bucket to store archives in, required when -archive-storage=s3")
+	flag.StringVar(&s3BasePath, "s3-base-path", "", "Key prefix under which archives are stored in the bucket")
+	flag.BoolVar(&s3UseSSL, "s3-use-ssl", true, "Use TLS when talking to the S3 endpoint")
 
 	flag.Parse()
 }
@@ -342,43 +433,19 @@ func printConfig() {
 	}
 }
 
-func setupGitLocalMirror() {
-	// setup local mirror
-	gitLocalMirrorDir, err := filepath.Abs(gitLocalMirrorDir)
+func setupMirror() {
+	cfg, err := loadMirrorConfig(configPath)
 	if err != nil {
-		errLog.Fatalf("failed to get absolute path for %q: %v", gitLocalMirrorDir, err)
+		errLog.Fatalf("failed to load repo config: %v", err)
 	}
 
-	gitMirrorRWMutex.Lock()
-	go func() {
-		defer gitMirrorRWMutex.Unlock()
-		if _, err := os.Stat(gitLocalMirrorDir); os.IsNotExist(err) {
-			infoLog.Printf("cloning local git mirror of remote %q in %q", gitRepositoryURL, gitLocalMirrorDir)
-			executeCommandOrFatalLog("git clone --mirror %s %q", gitRepositoryURL, gitLocalMirrorDir)
-		} else {
-			infoLog.Printf("updating local git mirror of remote %q in %q", gitRepositoryURL, gitLocalMirrorDir)
-			executeCommandOrFatalLog("git -C %q remote update", gitLocalMirrorDir)
-		}
-	}()
-
-	// Setup ticker for updating the git mirror
-	if gitUpdateMirrorTickerDuration != 0 {
-		updateGitMirrorTicker := time.NewTicker(gitUpdateMirrorTickerDuration)
-		go func() {
-			for {
-				select {
-				case t := <-updateGitMirrorTicker.C:
-					infoLog.Printf("updating git mirror at %s", t)
-					func() {
-						gitMirrorRWMutex.Lock()
-						defer gitMirrorRWMutex.Unlock()
-						executeCommandOrFatalLog("git -C %q remote update", gitLocalMirrorDir)
-					}()
-				}
-			}
-		}()
-		defer updateGitMirrorTicker.Stop()
+	mirror, err = newMirror(cfg)
+	if err != nil {
+		errLog.Fatalf("failed to set up mirror: %v", err)
 	}
+
+	infoLog.Printf("mirroring %d repo(s) from %q", len(cfg.Repos), configPath)
+	mirror.Start(shutdownCtx, gitUpdateMirrorTickerDuration)
 }
 
 func setupGitLocalClones() {
@@ -398,11 +465,16 @@ func setupGitLocalClones() {
 }
 
 func main() {
+	shutdownCtx, shutdownCancel = context.WithCancelCause(context.Background())
+	defer shutdownCancel(errors.New("main returned"))
+	forceKillCtx, forceKillCancel = context.WithCancelCause(context.Background())
+	defer forceKillCancel(errors.New("main returned"))
+
 	// TODO(kwk): Clean clone directory? Currently we have the ?freshClone=true URL-option to force this
 	setupFlags()
 	setupLogging()
 	printConfig()
-	setupGitLocalMirror()
+	setupMirror()
 	setupGitLocalClones()
 	setupArchivesCache()
 
@@ -411,7 +483,7 @@ func main() {
 	r := mux.NewRouter()
 
 	// https://gowebexamples.com/advanced-middleware/
-	r.HandleFunc("/archive/{archiveMethod}/{revisionOrTag}/{archiveName}/",
+	r.HandleFunc("/archive/{repo}/{archiveMethod}/{revisionOrTag}/{archiveName}/",
 		Chain(HandleArchive, EnsureMethod(http.MethodGet), Logging()))
 
 	r.HandleFunc("/status",
@@ -435,22 +507,34 @@ func main() {
 	}()
 
 	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, os.Interrupt)
+	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C), or via
+	// SIGTERM/SIGQUIT/SIGHUP as sent by systemd/Kubernetes/`kill`.
+	// SIGKILL will not be caught.
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
 
 	// Block until we receive our signal.
-	<-c
+	sig := <-c
+	infoLog.Printf("received signal %s, draining for up to %s", sig, shutDownWaitDuration)
+	shutdownCancel(fmt.Errorf("received signal %s", sig))
+
+	start := time.Now()
 
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), shutDownWaitDuration)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
-	// until the timeout deadline.
-	srv.Shutdown(ctx)
-	// Optionally, you could run srv.Shutdown in a goroutine and block on
-	// <-ctx.Done() if your application should wait for other services
-	// to finalize based on context cancellation.
-	infoLog.Println("Shutting down server and exiting")
+	// until the timeout deadline for in-flight archive builds to finish.
+	err := srv.Shutdown(ctx)
+	elapsed := time.Since(start)
+	if err != nil {
+		// The grace period elapsed with builds still in flight: cancel
+		// forceKillCtx so every gitRunner/tar subprocess still running
+		// gets killed instead of orphaned, then force-exit.
+		forceKillCancel(fmt.Errorf("graceful shutdown timed out after %s: %w", elapsed, err))
+		errLog.Printf("forced shutdown after %s: %v", elapsed, err)
+		os.Exit(1)
+	}
+
+	infoLog.Printf("graceful shutdown finished after %s", elapsed)
 	os.Exit(0)
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RepoConfig is one entry of the -config repos file.
+type RepoConfig struct {
+	Name          string `yaml:"name" json:"name"`
+	URL           string `yaml:"url" json:"url"`
+	MirrorDir     string `yaml:"mirrorDir" json:"mirrorDir"`
+	DefaultBranch string `yaml:"defaultBranch" json:"defaultBranch"`
+	// AuthTokenEnv, if set, names an environment variable holding a bearer
+	// token for cloning/fetching a private repo. The token itself never
+	// goes in the config file (or this struct's JSON encoding, which is
+	// served at /status) - only the env var's name does.
+	AuthTokenEnv string `yaml:"authTokenEnv" json:"authTokenEnv,omitempty"`
+}
+
+// MirrorConfig is the top-level shape of the -config repos file (YAML, or
+// JSON since JSON is valid YAML).
+type MirrorConfig struct {
+	Repos []RepoConfig `yaml:"repos" json:"repos"`
+}
+
+// loadMirrorConfig reads and validates the -config repos file.
+func loadMirrorConfig(path string) (*MirrorConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %q: %w", path, err)
+	}
+	var cfg MirrorConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %q: %w", path, err)
+	}
+	if len(cfg.Repos) == 0 {
+		return nil, fmt.Errorf("config %q defines no repos", path)
+	}
+	for _, rc := range cfg.Repos {
+		if rc.Name == "" || rc.URL == "" || rc.MirrorDir == "" {
+			return nil, fmt.Errorf("config %q: repo entry %+v is missing name, url or mirrorDir", path, rc)
+		}
+	}
+	return &cfg, nil
+}
+
+// RepoStatus is the per-repo status reported at /status.
+type RepoStatus struct {
+	LastFetch   time.Time `json:"lastFetch"`
+	LastError   string    `json:"lastError,omitempty"`
+	DefaultHead string    `json:"defaultHead,omitempty"`
+}
+
+// Repo is one git repository the server mirrors and serves archives from.
+// Each Repo owns its own lock and update ticker so repositories refresh
+// independently instead of all sharing one global lock, analogous to the
+// gitmirror refactor that introduced per-repo Loops.
+type Repo struct {
+	Name           string
+	URL            string
+	LocalMirrorDir string
+	DefaultBranch  string
+
+	// authToken is the resolved value of the config's AuthTokenEnv, kept
+	// unexported so it can never leak through RepoStatus or another
+	// exported field. Empty means the repo is cloned/fetched anonymously.
+	authToken string
+
+	mu     sync.RWMutex
+	tickle chan struct{}
+
+	statusMu sync.RWMutex
+	status   RepoStatus
+}
+
+func newRepo(c RepoConfig) (*Repo, error) {
+	dir, err := filepath.Abs(c.MirrorDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for %q: %w", c.MirrorDir, err)
+	}
+	branch := c.DefaultBranch
+	if branch == "" {
+		branch = "main"
+	}
+	var authToken string
+	if c.AuthTokenEnv != "" {
+		authToken = os.Getenv(c.AuthTokenEnv)
+		if authToken == "" {
+			return nil, fmt.Errorf("repo %q: authTokenEnv %q is not set", c.Name, c.AuthTokenEnv)
+		}
+	}
+	return &Repo{
+		Name:           c.Name,
+		URL:            c.URL,
+		LocalMirrorDir: dir,
+		DefaultBranch:  branch,
+		authToken:      authToken,
+		tickle:         make(chan struct{}, 1),
+	}, nil
+}
+
+// authArgs returns the `-c http.extraHeader=...` args to splice in front of
+// a clone/fetch's own args when repo has an authToken, or nil for an
+// anonymous repo. Passed as a real argv entry (never through a shell), so
+// the token can't be used to break out into another git option.
+func (repo *Repo) authArgs() []string {
+	if repo.authToken == "" {
+		return nil
+	}
+	return []string{"-c", "http.extraHeader=Authorization: Bearer " + repo.authToken}
+}
+
+// RLock/RUnlock let HandleArchive read the mirror (clone/checkout) while
+// update() isn't writing to it.
+func (repo *Repo) RLock()   { repo.mu.RLock() }
+func (repo *Repo) RUnlock() { repo.mu.RUnlock() }
+
+// Tickle requests an out-of-band mirror update as soon as repo's Loop
+// goroutine is free, without waiting for the next ticker fire.
+func (repo *Repo) Tickle() {
+	select {
+	case repo.tickle <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns repo's last known fetch result.
+func (repo *Repo) Status() RepoStatus {
+	repo.statusMu.RLock()
+	defer repo.statusMu.RUnlock()
+	return repo.status
+}
+
+func (repo *Repo) setStatus(head string, err error) {
+	repo.statusMu.Lock()
+	defer repo.statusMu.Unlock()
+	repo.status.LastFetch = time.Now()
+	if err != nil {
+		repo.status.LastError = err.Error()
+		return
+	}
+	repo.status.LastError = ""
+	repo.status.DefaultHead = head
+}
+
+// update clones the mirror if it doesn't exist yet, or fetches into it
+// otherwise, and records the outcome in repo's status. ctx is the process's
+// shutdownCtx, so an update that's still running when the grace period in
+// main elapses gets its git subprocess killed instead of orphaned.
+func (repo *Repo) update(ctx context.Context) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, err := os.Stat(repo.LocalMirrorDir); os.IsNotExist(err) {
+		infoLog.Printf("cloning local git mirror of remote %q in %q", repo.URL, repo.LocalMirrorDir)
+		args := append(repo.authArgs(), "clone", "--mirror", repo.URL, repo.LocalMirrorDir)
+		if _, err := gitRunner.Run(ctx, "", args...); err != nil {
+			errLog.Printf("failed to clone mirror for repo %q: %v", repo.Name, err)
+			repo.setStatus("", err)
+			return
+		}
+	} else {
+		infoLog.Printf("updating local git mirror of remote %q in %q", repo.URL, repo.LocalMirrorDir)
+		args := append(repo.authArgs(), "remote", "update")
+		if _, err := gitRunner.Run(ctx, repo.LocalMirrorDir, args...); err != nil {
+			errLog.Printf("failed to update mirror for repo %q: %v", repo.Name, err)
+			repo.setStatus("", err)
+			return
+		}
+	}
+
+	out, err := gitRunner.Run(ctx, repo.LocalMirrorDir, "rev-parse", "refs/heads/"+repo.DefaultBranch)
+	if err != nil {
+		errLog.Printf("failed to resolve HEAD of %q for repo %q: %v", repo.DefaultBranch, repo.Name, err)
+		repo.setStatus("", err)
+		return
+	}
+	repo.setStatus(strings.TrimSpace(string(out)), nil)
+}
+
+// Loop updates repo on a timer and whenever Tickle is called, until
+// ctx is cancelled. It returns immediately if tickerDuration is 0.
+func (repo *Repo) Loop(ctx context.Context, tickerDuration time.Duration) {
+	if tickerDuration == 0 {
+		return
+	}
+	ticker := time.NewTicker(tickerDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			infoLog.Printf("updating git mirror of %q at %s", repo.Name, t)
+			repo.update(ctx)
+		case <-repo.tickle:
+			infoLog.Printf("on-demand update of git mirror of %q", repo.Name)
+			repo.update(ctx)
+		case <-ctx.Done():
+			infoLog.Printf("stopping git mirror updates of %q: %v", repo.Name, context.Cause(ctx))
+			return
+		}
+	}
+}
+
+// Mirror owns every repo configured via -config and their background
+// update loops.
+type Mirror struct {
+	mu    sync.RWMutex
+	repos map[string]*Repo
+}
+
+// newMirror builds a Mirror from cfg. It doesn't clone or fetch anything
+// yet; call Start for that.
+func newMirror(cfg *MirrorConfig) (*Mirror, error) {
+	m := &Mirror{repos: map[string]*Repo{}}
+	for _, rc := range cfg.Repos {
+		repo, err := newRepo(rc)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := m.repos[repo.Name]; exists {
+			return nil, fmt.Errorf("duplicate repo name %q in config", repo.Name)
+		}
+		m.repos[repo.Name] = repo
+	}
+	return m, nil
+}
+
+// Get returns the named repo, or false if it isn't configured.
+func (m *Mirror) Get(name string) (*Repo, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	repo, ok := m.repos[name]
+	return repo, ok
+}
+
+// Start clones/fetches every repo once in the background and then begins
+// its update Loop. It returns immediately; HandleArchive's RLock on a repo
+// blocks until that repo's initial clone/fetch has finished. ctx is the
+// process's shutdownCtx; cancelling it stops every repo's Loop.
+func (m *Mirror) Start(ctx context.Context, tickerDuration time.Duration) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, repo := range m.repos {
+		repo := repo
+		go func() {
+			repo.update(ctx)
+			repo.Loop(ctx, tickerDuration)
+		}()
+	}
+}
+
+// Status returns every repo's current status keyed by name.
+func (m *Mirror) Status() map[string]RepoStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	statuses := make(map[string]RepoStatus, len(m.repos))
+	for name, repo := range m.repos {
+		statuses[name] = repo.Status()
+	}
+	return statuses
+}
+
+// HandleStatus reports every configured repo's mirror status as JSON.
+func HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(http.CanonicalHeaderKey("Content-Type"), "application/json")
+	if err := json.NewEncoder(w).Encode(mirror.Status()); err != nil {
+		errLog.Printf("failed to encode status response: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3ArchiveStore stores archives as objects in an S3-compatible bucket (AWS
+// S3 or MinIO), so a horizontally scaled fleet of servers can share one
+// archive cache instead of each instance keeping its own local-disk copy.
+type s3ArchiveStore struct {
+	client   *minio.Client
+	bucket   string
+	basePath string
+}
+
+// newS3ArchiveStore connects to the S3-compatible endpoint and returns a
+// store that keeps objects under basePath in bucket. Credentials are taken
+// from the environment (AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY or the
+// usual AWS credential chain).
+func newS3ArchiveStore(endpoint, bucket, basePath string, useSSL bool) (*s3ArchiveStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewEnvAWS(),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client for %q: %w", endpoint, err)
+	}
+	return &s3ArchiveStore{client: client, bucket: bucket, basePath: basePath}, nil
+}
+
+func (s *s3ArchiveStore) key(name string) string {
+	return path.Join(s.basePath, name)
+}
+
+func (s *s3ArchiveStore) Stat(name string) (ArchiveEntry, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ArchiveEntry{}, ErrArchiveNotFound
+		}
+		return ArchiveEntry{}, err
+	}
+	return ArchiveEntry{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3ArchiveStore) Put(name string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), r, -1, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *s3ArchiveStore) Open(name string) (io.ReadCloser, ArchiveEntry, error) {
+	entry, err := s.Stat(name)
+	if err != nil {
+		return nil, ArchiveEntry{}, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ArchiveEntry{}, err
+	}
+	return obj, entry, nil
+}
+
+func (s *s3ArchiveStore) Delete(name string) error {
+	err := s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return ErrArchiveNotFound
+	}
+	return err
+}
+
+func (s *s3ArchiveStore) List() ([]ArchiveEntry, error) {
+	var entries []ArchiveEntry
+	prefix := s.basePath
+	if prefix != "" {
+		prefix += "/"
+	}
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		entries = append(entries, ArchiveEntry{
+			Name:    strings.TrimPrefix(obj.Key, prefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return entries, nil
+}